@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Compression codec names, recorded per-entry in the TOC/packfile index.
+// Get decodes with the store-wide codec taken from the file header
+// (s.compression), not with the per-entry value.
+const (
+	compressionNone = ""
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+)
+
+// codecFlag bits packed into the on-disk header, right after the version.
+const (
+	codecFlagCompressionMask uint8 = 0x03 // 0=none, 1=zstd, 2=gzip
+	codecFlagEncrypted       uint8 = 0x04
+)
+
+// scrypt parameters for deriving the AES-256 key from a passphrase. Fixed
+// rather than negotiated, to keep the on-disk kdfParams down to just the
+// salt.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+func compressionToFlag(c string) uint8 {
+	switch c {
+	case compressionZstd:
+		return 1
+	case compressionGzip:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func flagToCompression(f uint8) (string, error) {
+	switch f & codecFlagCompressionMask {
+	case 0:
+		return compressionNone, nil
+	case 1:
+		return compressionZstd, nil
+	case 2:
+		return compressionGzip, nil
+	default:
+		return "", fmt.Errorf("unknown compression flag: %d", f&codecFlagCompressionMask)
+	}
+}
+
+// negotiateCodec reads storeConfig["compression"] and storeConfig["passphrase"]
+// to decide how newly created archives should be encoded, deriving the
+// AES-256 key from the passphrase (or refusing a "KMS://" URI, which isn't
+// wired up yet) against the freshly generated salt.
+func negotiateCodec(storeConfig map[string]string, salt [16]byte) (compression string, key []byte, flags uint8, err error) {
+	switch storeConfig["compression"] {
+	case "", "none":
+		compression = compressionNone
+	case "zstd":
+		compression = compressionZstd
+	case "gzip":
+		compression = compressionGzip
+	default:
+		return "", nil, 0, fmt.Errorf("unknown compression codec: %s", storeConfig["compression"])
+	}
+	flags = compressionToFlag(compression)
+
+	passphrase := storeConfig["passphrase"]
+	if passphrase == "" {
+		return compression, nil, flags, nil
+	}
+
+	if strings.HasPrefix(passphrase, "KMS://") {
+		return "", nil, 0, fmt.Errorf("KMS-backed passphrases are not supported yet: %s", passphrase)
+	}
+
+	key, err = scrypt.Key([]byte(passphrase), salt[:], scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	flags |= codecFlagEncrypted
+
+	return compression, key, flags, nil
+}
+
+// resolveCodec is negotiateCodec's counterpart for Open: the salt and flags
+// come from the file header, so only the compression name and (if the
+// encrypted flag is set) the key need to be derived.
+func resolveCodec(storeConfig map[string]string, flags uint8, salt [16]byte) (compression string, key []byte, err error) {
+	compression, err = flagToCompression(flags)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if flags&codecFlagEncrypted == 0 {
+		return compression, nil, nil
+	}
+
+	passphrase := storeConfig["passphrase"]
+	if passphrase == "" {
+		return "", nil, fmt.Errorf("archive is encrypted, a passphrase is required")
+	}
+	if strings.HasPrefix(passphrase, "KMS://") {
+		return "", nil, fmt.Errorf("KMS-backed passphrases are not supported yet: %s", passphrase)
+	}
+
+	key, err = scrypt.Key([]byte(passphrase), salt[:], scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return "", nil, err
+	}
+	return compression, key, nil
+}
+
+func compressWith(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case compressionNone:
+		return data, nil
+
+	case compressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+
+	case compressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+}
+
+func decompressWith(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case compressionNone:
+		return data, nil
+
+	case compressionZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+}
+
+func encryptWith(key, plain []byte) (ciphertext, nonce []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return gcm.Seal(nil, nonce, plain, nil), nonce, nil
+}
+
+func decryptWith(key, ciphertext, nonce []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// encodeSection compresses then (if the store was created with a passphrase)
+// encrypts plain, returning the bytes to write to disk and the nonce to
+// record alongside them. Compression happens first since ciphertext doesn't
+// compress.
+func (s *Store) encodeSection(plain []byte) (out []byte, nonce []byte, err error) {
+	out, err = compressWith(s.compression, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.encKey != nil {
+		out, nonce, err = encryptWith(s.encKey, out)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return out, nonce, nil
+}
+
+// decodeSection is encodeSection's inverse.
+func (s *Store) decodeSection(data, nonce []byte) ([]byte, error) {
+	if s.encKey != nil {
+		var err error
+		data, err = decryptWith(s.encKey, data, nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompressWith(s.compression, data)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	plain := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog"), 64)
+
+	for _, codec := range []string{compressionNone, compressionZstd, compressionGzip} {
+		t.Run(codec, func(t *testing.T) {
+			encoded, err := compressWith(codec, plain)
+			if err != nil {
+				t.Fatalf("compressWith: %v", err)
+			}
+			decoded, err := decompressWith(codec, encoded)
+			if err != nil {
+				t.Fatalf("decompressWith: %v", err)
+			}
+			if !bytes.Equal(decoded, plain) {
+				t.Fatalf("round trip mismatch for codec %q", codec)
+			}
+		})
+	}
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32) // AES-256 key
+	plain := []byte("section bytes that need to stay secret at rest")
+
+	ciphertext, nonce, err := encryptWith(key, plain)
+	if err != nil {
+		t.Fatalf("encryptWith: %v", err)
+	}
+	if bytes.Equal(ciphertext, plain) {
+		t.Fatal("ciphertext must not equal plaintext")
+	}
+
+	decrypted, err := decryptWith(key, ciphertext, nonce)
+	if err != nil {
+		t.Fatalf("decryptWith: %v", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("got %q, want %q", decrypted, plain)
+	}
+}
+
+func TestDecryptWithWrongKeyFails(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	wrongKey := bytes.Repeat([]byte{0x24}, 32)
+	plain := []byte("top secret")
+
+	ciphertext, nonce, err := encryptWith(key, plain)
+	if err != nil {
+		t.Fatalf("encryptWith: %v", err)
+	}
+
+	if _, err := decryptWith(wrongKey, ciphertext, nonce); err == nil {
+		t.Fatal("expected an error decrypting with the wrong key")
+	}
+}
+
+func TestStoreEncodeDecodeSectionRoundTrip(t *testing.T) {
+	s := &Store{compression: compressionZstd, encKey: bytes.Repeat([]byte{0x11}, 32)}
+	plain := []byte("config bytes written by Create and read back by Open")
+
+	encoded, nonce, err := s.encodeSection(plain)
+	if err != nil {
+		t.Fatalf("encodeSection: %v", err)
+	}
+	if bytes.Equal(encoded, plain) {
+		t.Fatal("encoded section must not equal plaintext when compression and encryption are configured")
+	}
+
+	decoded, err := s.decodeSection(encoded, nonce)
+	if err != nil {
+		t.Fatalf("decodeSection: %v", err)
+	}
+	if !bytes.Equal(decoded, plain) {
+		t.Fatalf("got %q, want %q", decoded, plain)
+	}
+}
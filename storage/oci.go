@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ptarArtifactType is the artifactType recorded in the OCI image manifest so
+// that registries and tooling can tell a ptar archive apart from an OCI
+// container image at a glance.
+const ptarArtifactType types.MediaType = "application/vnd.plakar.ptar.v1+json"
+
+// ptarLayerMediaType is the media type of the single layer carrying the
+// archive bytes.
+const ptarLayerMediaType types.MediaType = "application/vnd.plakar.ptar.v1.archive"
+
+// ociBlob implements ReadWriteSeekStatReadAtCloser over the single ptar
+// layer of an OCI artifact. ReadAt issues an authenticated HTTP Range GET
+// against the blob directly rather than pulling it into memory, so a Get
+// for one packfile chunk (see the chunked packfile subsystem) only pulls
+// that chunk's bytes off the registry, not the whole archive.
+type ociBlob struct {
+	ref    name.Reference
+	digest v1.Hash
+	size   int64
+	url    string
+	client *http.Client
+
+	pos int64
+}
+
+// NewOCIReader resolves ref (e.g. "registry/repo:tag") to its image manifest,
+// locates the ptar layer, and returns a handle that serves reads and range
+// reads against it. Authentication goes through the default keychain, which
+// picks up `~/.docker/config.json` and platform credential helpers, exactly
+// like `docker pull`.
+func NewOCIReader(ref string) (ReadWriteSeekStatReadAtCloser, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI reference %q: %w", ref, err)
+	}
+
+	desc, err := remote.Get(r, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest for %q: %w", ref, err)
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image for %q: %w", ref, err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layers found in OCI artifact %q", ref)
+	}
+	layer := layers[0]
+
+	digest, err := layer.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layer digest for %q: %w", ref, err)
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layer size for %q: %w", ref, err)
+	}
+
+	repo := r.Context()
+	auth, err := authn.DefaultKeychain.Resolve(repo.Registry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve credentials for %q: %w", ref, err)
+	}
+	rt, err := transport.New(repo, auth, http.DefaultTransport, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up authenticated transport for %q: %w", ref, err)
+	}
+
+	return &ociBlob{
+		ref:    r,
+		digest: digest,
+		size:   size,
+		url:    fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), digest),
+		client: &http.Client{Transport: rt},
+	}, nil
+}
+
+// rangeGET fetches the [off, off+length) slice of the blob with an HTTP
+// Range header. A registry that doesn't honor Range (206) falls back to
+// slicing the full body it sent instead of failing the read outright.
+func (o *ociBlob) rangeGET(off, length int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, o.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return data, nil
+	case http.StatusOK:
+		if off >= int64(len(data)) {
+			return nil, io.EOF
+		}
+		end := off + length
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		return data[off:end], nil
+	default:
+		return nil, fmt.Errorf("blob range GET for %s failed: %s", o.digest, resp.Status)
+	}
+}
+
+func (o *ociBlob) Read(p []byte) (int, error) {
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *ociBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if off+length > o.size {
+		length = o.size - off
+	}
+
+	data, err := o.rangeGET(off, length)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *ociBlob) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = o.pos + offset
+	case io.SeekEnd:
+		newPos = o.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	o.pos = newPos
+	return o.pos, nil
+}
+
+func (o *ociBlob) Stat() (os.FileInfo, error) {
+	return nil, fmt.Errorf("stat is not supported on ptar+oci artifacts")
+}
+
+func (o *ociBlob) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("ptar+oci artifacts are immutable once pushed")
+}
+
+func (o *ociBlob) Close() error {
+	return nil
+}
+
+// pushOCIArtifact uploads the archive staged at s.ociStaging as a single
+// layer of an OCI artifact, tagged with ptarArtifactType, to the registry
+// named by s.host (e.g. "registry/repo:tag").
+func (s *Store) pushOCIArtifact() error {
+	defer os.Remove(s.ociStaging)
+
+	r, err := name.ParseReference(s.host)
+	if err != nil {
+		return fmt.Errorf("invalid OCI reference %q: %w", s.host, err)
+	}
+
+	layer, err := newPtarLayer(s.ociStaging)
+	if err != nil {
+		return err
+	}
+
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return err
+	}
+	img = mutate.MediaType(img, ptarArtifactType)
+	img = mutate.ArtifactType(img, string(ptarArtifactType))
+
+	return remote.Write(r, img, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+// newPtarLayer wraps the archive bytes at path as a single static layer,
+// the same approach ORAS-style OCI artifacts use for non-image payloads.
+func newPtarLayer(path string) (v1.Layer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return static.NewLayer(data, ptarLayerMediaType), nil
+}
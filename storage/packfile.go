@@ -0,0 +1,423 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/versioning"
+)
+
+// defaultChunkSize is used when a store isn't configured with an explicit
+// "chunk-size", matching the eStargz-style chunking used for range reads.
+const defaultChunkSize = 4 * 1024 * 1024
+
+const (
+	tocFormatRaw     = "raw"
+	tocFormatChunked = "chunked"
+)
+
+// ErrCorruptChunk is returned by Get when a chunk's bytes don't hash to the
+// MAC recorded for it in the packfile index, instead of silently returning
+// corrupted data to the caller.
+var ErrCorruptChunk = errors.New("ptar: corrupt chunk: MAC mismatch")
+
+// chunkEntry describes one fixed-size slice of a packfile. Offset/Length
+// describe the bytes on disk, which may be compressed and/or encrypted;
+// PlainLength is the size of the chunk's plaintext, needed to do range math
+// before the chunk has been read and decoded.
+type chunkEntry struct {
+	MAC         objects.MAC `json:"mac"`
+	Offset      int64       `json:"offset"`
+	Length      int64       `json:"length"`
+	PlainLength int64       `json:"plain_length,omitempty"`
+	Compression string      `json:"compression,omitempty"`
+	Nonce       []byte      `json:"nonce,omitempty"`
+	Tombstoned  bool        `json:"tombstoned,omitempty"`
+}
+
+// plainLength returns c.PlainLength, falling back to c.Length for chunks
+// written before PlainLength existed (i.e. always unencoded, so the two
+// coincide).
+func (c chunkEntry) plainLength() int64 {
+	if c.PlainLength != 0 {
+		return c.PlainLength
+	}
+	return c.Length
+}
+
+// packfileIndex is itself stored as a blob, referenced by the top-level TOC
+// entry for a packfile resource, so that Get can verify and serve individual
+// chunks without having to touch the ones it doesn't need.
+type packfileIndex struct {
+	MAC       objects.MAC  `json:"mac"`
+	ChunkSize int64        `json:"chunk_size"`
+	Chunks    []chunkEntry `json:"chunks"`
+}
+
+// putPackfile writes rd as a sequence of s.chunkSize chunks, each individually
+// MAC'd, and appends a packfileIndex blob describing them. The top-level TOC
+// entry's offset/length point at that index rather than at the data itself.
+func (s *Store) putPackfile(mac objects.MAC, rd io.Reader) (int64, error) {
+	var chunks []chunkEntry
+	var total int64
+
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(rd, buf)
+		if n > 0 {
+			plain := buf[:n]
+			chunkMAC := macOf(plain)
+
+			encoded, nonce, eerr := s.encodeSection(plain)
+			if eerr != nil {
+				return 0, eerr
+			}
+
+			offset := s.dataEnd
+			if _, serr := s.fp.Seek(offset, io.SeekStart); serr != nil {
+				return 0, serr
+			}
+			if _, werr := s.fp.Write(encoded); werr != nil {
+				return 0, werr
+			}
+
+			chunks = append(chunks, chunkEntry{
+				MAC:         chunkMAC,
+				Offset:      offset,
+				Length:      int64(len(encoded)),
+				PlainLength: int64(n),
+				Compression: s.compression,
+				Nonce:       nonce,
+			})
+			s.dataEnd = offset + int64(len(encoded))
+			total += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	idxBytes, err := json.Marshal(packfileIndex{MAC: mac, ChunkSize: s.chunkSize, Chunks: chunks})
+	if err != nil {
+		return 0, err
+	}
+
+	idxOffset := s.dataEnd
+	if _, err := s.fp.Seek(idxOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := s.fp.Write(idxBytes); err != nil {
+		return 0, err
+	}
+	s.dataEnd = idxOffset + int64(len(idxBytes))
+
+	s.toc.Entries = append(s.toc.Entries, tocEntry{
+		MAC:       mac,
+		Offset:    idxOffset,
+		Length:    int64(len(idxBytes)),
+		Kind:      tocKindPackfile,
+		CreatedAt: time.Now(),
+		Format:    tocFormatChunked,
+	})
+
+	return total, nil
+}
+
+func (s *Store) loadPackfileIndex(entry tocEntry) (packfileIndex, error) {
+	buf := make([]byte, entry.Length)
+	if _, err := s.fp.ReadAt(buf, entry.Offset); err != nil {
+		return packfileIndex{}, err
+	}
+
+	var idx packfileIndex
+	if err := json.Unmarshal(buf, &idx); err != nil {
+		return packfileIndex{}, err
+	}
+	return idx, nil
+}
+
+// getPackfile serves rg (or the whole packfile, if rg is nil) by reading
+// only the chunks that intersect the requested range and verifying each
+// one's MAC before handing its bytes back.
+func (s *Store) getPackfile(entry tocEntry, rg *storage.Range) (io.ReadCloser, error) {
+	idx, err := s.loadPackfileIndex(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var start, end int64
+	if rg == nil {
+		for _, c := range idx.Chunks {
+			if !c.Tombstoned {
+				end += c.plainLength()
+			}
+		}
+	} else {
+		start = int64(rg.Offset)
+		end = start + int64(rg.Length)
+	}
+
+	var out []byte
+	var pos int64
+	for _, c := range idx.Chunks {
+		if c.Tombstoned {
+			continue
+		}
+
+		plainLen := c.plainLength()
+		chunkStart, chunkEnd := pos, pos+plainLen
+		pos = chunkEnd
+
+		if chunkEnd <= start || chunkStart >= end {
+			continue
+		}
+
+		data := make([]byte, c.Length)
+		if _, err := s.fp.ReadAt(data, c.Offset); err != nil {
+			return nil, err
+		}
+
+		plain, err := s.decodeSection(data, c.Nonce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk at offset %d: %w", c.Offset, err)
+		}
+		if macOf(plain) != c.MAC {
+			return nil, fmt.Errorf("%w: chunk at offset %d", ErrCorruptChunk, c.Offset)
+		}
+
+		lo, hi := int64(0), plainLen
+		if chunkStart < start {
+			lo = start - chunkStart
+		}
+		if chunkEnd > end {
+			hi = end - chunkStart
+		}
+		out = append(out, plain[lo:hi]...)
+	}
+
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+// deletePackfile tombstones every chunk of the named packfile by appending
+// an updated index with Tombstoned set and repointing the TOC entry at it.
+// The dead chunks and the superseded index stay in the file until Compact
+// reclaims them.
+func (s *Store) deletePackfile(mac objects.MAC) error {
+	for i := range s.toc.Entries {
+		entry := &s.toc.Entries[i]
+		if entry.Kind != tocKindPackfile || entry.MAC != mac {
+			continue
+		}
+
+		if entry.Format != tocFormatChunked {
+			s.toc.Entries = append(s.toc.Entries[:i], s.toc.Entries[i+1:]...)
+			return nil
+		}
+
+		idx, err := s.loadPackfileIndex(*entry)
+		if err != nil {
+			return err
+		}
+		for j := range idx.Chunks {
+			idx.Chunks[j].Tombstoned = true
+		}
+
+		idxBytes, err := json.Marshal(idx)
+		if err != nil {
+			return err
+		}
+
+		offset := s.dataEnd
+		if _, err := s.fp.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := s.fp.Write(idxBytes); err != nil {
+			return err
+		}
+		s.dataEnd = offset + int64(len(idxBytes))
+
+		entry.Offset = offset
+		entry.Length = int64(len(idxBytes))
+		return nil
+	}
+
+	return fmt.Errorf("invalid MAC: %s", mac)
+}
+
+// Compact rewrites the archive into a fresh file, dropping tombstoned chunks
+// and the packfile index generations they made dead, then atomically
+// replaces the original. It is meant to be run offline, against a store that
+// nothing else is concurrently writing to.
+func (s *Store) Compact(ctx context.Context) error {
+	if s.streaming {
+		return fmt.Errorf("Compact is not supported for streaming archives")
+	}
+	if s.mode&storage.ModeWrite == 0 {
+		return storage.ErrNotWritable
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.root), "ptar-compact-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	tmp.Write(footerMagic[:])
+	versionBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(versionBytes, uint32(versioning.FromString(currentVersion)))
+	tmp.Write(versionBytes)
+
+	flags := compressionToFlag(s.compression)
+	if s.encKey != nil {
+		flags |= codecFlagEncrypted
+	}
+	tmp.Write([]byte{flags})
+	tmp.Write(s.salt[:])
+
+	var newToc toc
+	dataEnd := headerSize
+
+	for _, entry := range s.toc.Entries {
+		if entry.Kind == tocKindPackfile && entry.Format == tocFormatChunked {
+			idx, err := s.loadPackfileIndex(entry)
+			if err != nil {
+				return err
+			}
+
+			var liveChunks []chunkEntry
+			for _, c := range idx.Chunks {
+				if c.Tombstoned {
+					continue
+				}
+
+				data := make([]byte, c.Length)
+				if _, err := s.fp.ReadAt(data, c.Offset); err != nil {
+					return err
+				}
+				newOffset := dataEnd
+				if _, err := tmp.WriteAt(data, newOffset); err != nil {
+					return err
+				}
+				dataEnd += int64(len(data))
+				liveChunks = append(liveChunks, chunkEntry{
+					MAC:         c.MAC,
+					Offset:      newOffset,
+					Length:      c.Length,
+					PlainLength: c.PlainLength,
+					Compression: c.Compression,
+					Nonce:       c.Nonce,
+				})
+			}
+
+			idxBytes, err := json.Marshal(packfileIndex{MAC: idx.MAC, ChunkSize: idx.ChunkSize, Chunks: liveChunks})
+			if err != nil {
+				return err
+			}
+			idxOffset := dataEnd
+			if _, err := tmp.WriteAt(idxBytes, idxOffset); err != nil {
+				return err
+			}
+			dataEnd += int64(len(idxBytes))
+
+			newToc.Entries = append(newToc.Entries, tocEntry{
+				MAC:       entry.MAC,
+				Offset:    idxOffset,
+				Length:    int64(len(idxBytes)),
+				Kind:      tocKindPackfile,
+				CreatedAt: entry.CreatedAt,
+				Format:    tocFormatChunked,
+			})
+			continue
+		}
+
+		data := make([]byte, entry.Length)
+		if _, err := s.fp.ReadAt(data, entry.Offset); err != nil {
+			return err
+		}
+		newOffset := dataEnd
+		if _, err := tmp.WriteAt(data, newOffset); err != nil {
+			return err
+		}
+		dataEnd += int64(len(data))
+
+		newEntry := entry
+		newEntry.Offset = newOffset
+		newToc.Entries = append(newToc.Entries, newEntry)
+	}
+
+	tocBytes, err := json.Marshal(newToc)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteAt(tocBytes, dataEnd); err != nil {
+		return err
+	}
+
+	ft := footer{
+		TocOffset: dataEnd,
+		TocLength: int64(len(tocBytes)),
+		TocMAC:    macOf(tocBytes),
+		Magic:     footerMagic,
+		Version:   uint32(versioning.FromString(currentVersion)),
+	}
+
+	if _, err := tmp.Seek(dataEnd+int64(len(tocBytes)), io.SeekStart); err != nil {
+		return err
+	}
+	binary.Write(tmp, binary.LittleEndian, ft.TocOffset)
+	binary.Write(tmp, binary.LittleEndian, ft.TocLength)
+	binary.Write(tmp, binary.LittleEndian, ft.TocMAC)
+	binary.Write(tmp, binary.LittleEndian, ft.Magic)
+	binary.Write(tmp, binary.LittleEndian, ft.Version)
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := s.fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.root); err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(s.root, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	s.fp = fp
+	s.toc = newToc
+	s.dataEnd = dataEnd
+
+	return nil
+}
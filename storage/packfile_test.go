@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// newTestStore returns a Store backed by a temp file, with no compression or
+// encryption configured, ready to exercise putPackfile/getPackfile directly.
+func newTestStore(t *testing.T, chunkSize int64) *Store {
+	t.Helper()
+
+	fp, err := os.CreateTemp(t.TempDir(), "ptar-packfile-test-*.bin")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	t.Cleanup(func() { fp.Close() })
+
+	return &Store{fp: fp, chunkSize: chunkSize}
+}
+
+func TestPackfileRangeStraddlesChunkBoundary(t *testing.T) {
+	s := newTestStore(t, 8)
+
+	data := append(bytes.Repeat([]byte("A"), 8), bytes.Repeat([]byte("B"), 8)...)
+	data = append(data, []byte("XY")...) // three chunks: 8, 8, 2 bytes
+
+	mac := objects.MAC{0x01}
+	if _, err := s.putPackfile(mac, bytes.NewReader(data)); err != nil {
+		t.Fatalf("putPackfile: %v", err)
+	}
+	entry := s.toc.Entries[0]
+
+	rc, err := s.getPackfile(entry, &storage.Range{Offset: 4, Length: 8})
+	if err != nil {
+		t.Fatalf("getPackfile: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read range: %v", err)
+	}
+	if want := data[4:12]; !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPackfileRangeOverrunDoesNotPanic(t *testing.T) {
+	s := newTestStore(t, 8)
+
+	data := []byte("hello world") // 11 bytes, two chunks: 8, 3
+	mac := objects.MAC{0x02}
+	if _, err := s.putPackfile(mac, bytes.NewReader(data)); err != nil {
+		t.Fatalf("putPackfile: %v", err)
+	}
+	entry := s.toc.Entries[0]
+
+	rc, err := s.getPackfile(entry, &storage.Range{Offset: 5, Length: 1000})
+	if err != nil {
+		t.Fatalf("getPackfile: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read range: %v", err)
+	}
+	if want := data[5:]; !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPackfileCorruptChunkMACIsDetected(t *testing.T) {
+	s := newTestStore(t, 8)
+
+	data := []byte("hello world")
+	mac := objects.MAC{0x03}
+	if _, err := s.putPackfile(mac, bytes.NewReader(data)); err != nil {
+		t.Fatalf("putPackfile: %v", err)
+	}
+	entry := s.toc.Entries[0]
+
+	idx, err := s.loadPackfileIndex(entry)
+	if err != nil {
+		t.Fatalf("loadPackfileIndex: %v", err)
+	}
+	if len(idx.Chunks) == 0 {
+		t.Fatalf("expected at least one chunk")
+	}
+
+	if _, err := s.fp.Seek(idx.Chunks[0].Offset, io.SeekStart); err != nil {
+		t.Fatalf("seek to chunk: %v", err)
+	}
+	if _, err := s.fp.Write([]byte{'!'}); err != nil {
+		t.Fatalf("corrupt chunk: %v", err)
+	}
+
+	if _, err := s.getPackfile(entry, nil); !errors.Is(err, ErrCorruptChunk) {
+		t.Fatalf("got %v, want %v", err, ErrCorruptChunk)
+	}
+}
@@ -19,21 +19,96 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/PlakarKorp/kloset/connectors/storage"
 	"github.com/PlakarKorp/kloset/location"
 	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/kloset/versioning"
-	"github.com/dustin/go-humanize"
 )
 
+// tocEntryKind identifies which StorageResource a tocEntry belongs to.
+type tocEntryKind string
+
+const (
+	tocKindConfig   tocEntryKind = "config"
+	tocKindPackfile tocEntryKind = "packfile"
+	tocKindState    tocEntryKind = "state"
+	tocKindLock     tocEntryKind = "lock"
+)
+
+// tocEntry describes one resource stored in the archive. The table of
+// contents is a flat list of these, appended to as resources are written,
+// so that `List` and `Get` can address any resource written to the file
+// without having to trust a single fixed offset/length pair per kind.
+type tocEntry struct {
+	MAC         objects.MAC  `json:"mac"`
+	Offset      int64        `json:"offset"`
+	Length      int64        `json:"length"`
+	Kind        tocEntryKind `json:"kind"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Compression string       `json:"compression,omitempty"`
+	Nonce       []byte       `json:"nonce,omitempty"` // set when the section was encrypted
+
+	// Format distinguishes how a packfile resource's bytes are laid out.
+	// Anything other than tocFormatChunked (empty or tocFormatRaw) means
+	// offset/length point directly at a single contiguous blob; Put does not
+	// write packfiles in that layout, Get and Compact still serve it. tocFormatChunked
+	// means offset/length instead point at a packfileIndex blob describing
+	// the chunks that make up the packfile.
+	Format string `json:"format,omitempty"`
+}
+
+// toc is the table of contents written at the tail of the archive, right
+// before the fixed-size footer. It enumerates the resources written to the
+// file (deleting a non-chunked packfile drops its entry), in the spirit of eStargz's trailing TOC: a self-describing
+// index that turns an otherwise opaque stream into something seekable and
+// appendable.
+type toc struct {
+	Entries []tocEntry `json:"entries"`
+}
+
+// footer is the fixed-size trailer that lets Open locate the TOC without
+// having to scan the file. Everything else about the format (number of
+// resources, their kinds, their placement) lives in the TOC itself.
+type footer struct {
+	TocOffset int64
+	TocLength int64
+	TocMAC    objects.MAC
+	Magic     [8]byte
+	Version   uint32
+}
+
+var footerMagic = [8]byte{'_', 'P', 'L', 'A', 'T', 'A', 'R', '_'}
+
+// currentVersion is the on-disk format version stamped on archives written
+// by this build. Neither Open nor Put reads it back: Put always writes
+// chunked, content-addressable packfiles (see packfile.go), and Get and
+// Compact tell a packfile's layout apart by its per-entry Format field.
+// Open does not read archives in the 1.0.0 layout, which has no TOC.
+const currentVersion = "1.1.0"
+
+// footerSize is computed once from the actual wire size of footer's fields
+// rather than hardcoded, so a change in objects.MAC's width doesn't silently
+// desync reader and writer.
+var footerSize = int64(binary.Size(int64(0))*2 + binary.Size(objects.MAC{}) + binary.Size([8]byte{}) + binary.Size(uint32(0)))
+
+// headerSize is magic + version + codecFlags + the scrypt salt used to
+// derive the encryption key, i.e. everything Open needs to read before it
+// can even get at the (possibly encrypted) config section.
+var headerSize = int64(len(footerMagic)) + int64(binary.Size(uint32(0))) + int64(binary.Size(uint8(0))) + int64(binary.Size([16]byte{}))
+
 type Store struct {
 	config     []byte
 	Repository string
@@ -45,67 +120,156 @@ type Store struct {
 
 	fp ReadWriteSeekStatReadAtCloser
 
-	configOffset int64
-	configLength int64
+	proto string
 
-	packfileOffset int64
-	packfileLength int64
+	toc     toc
+	dataEnd int64 // offset just past the last resource written, i.e. where the next Put appends
 
-	stateOffset int64
-	stateLength int64
+	ociStaging string // local path the archive is built at before being pushed as an OCI artifact
 
-	proto string
-}
+	chunkSize int64 // packfile chunk size for newly written packfiles
+
+	streaming   bool // true for ptar://-, where fp is replaced by sequential stdio access
+	streamOut   io.Writer
+	streamIn    io.Reader
+	streamBlobs map[streamKey][]byte
+
+	storeConfig map[string]string // kept around to resolve the passphrase once the on-disk salt is known
 
-var stateMAC = objects.MAC{0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00}
-var packfileMAC = objects.MAC{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	compression string   // codec applied to section bytes before they're written
+	encKey      []byte   // AES-256 key derived from storeConfig["passphrase"], nil if archive is unencrypted
+	salt        [16]byte // scrypt salt recorded in the header, needed again if the archive is later compacted
+}
 
 func init() {
 	storage.Register("ptar", location.FLAG_LOCALFS|location.FLAG_FILE, NewStore)
 	storage.Register("ptar+http", location.FLAG_FILE, NewStore)
 	storage.Register("ptar+https", location.FLAG_FILE, NewStore)
+	storage.Register("ptar+oci", location.FLAG_FILE, NewStore)
 }
 
 func NewStore(ctx context.Context, proto string, storeConfig map[string]string) (storage.Store, error) {
+	chunkSize := int64(defaultChunkSize)
+	if v, ok := storeConfig["chunk-size"]; ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			chunkSize = n
+		}
+	}
+
 	return &Store{
-		location: storeConfig["location"],
-		proto:    proto,
+		location:    storeConfig["location"],
+		proto:       proto,
+		chunkSize:   chunkSize,
+		storeConfig: storeConfig,
 	}, nil
 }
 
+// macOf computes the MAC of a blob of bytes: the TOC blob (checked against
+// the footer on Open), the config section's TOC entry, and each packfile
+// chunk (checked by getPackfile). It is not the content-addressing scheme
+// used for packfiles/states -- those MACs are handed to us by the caller of
+// Put.
+func macOf(data []byte) objects.MAC {
+	sum := sha256.Sum256(data)
+	var mac objects.MAC
+	copy(mac[:], sum[:])
+	return mac
+}
+
 func (s *Store) Create(ctx context.Context, config []byte) error {
 	s.config = config
 	s.mode = storage.ModeRead | storage.ModeWrite
 
-	if s.proto != "ptar" {
+	var fp ReadWriteSeekStatReadAtCloser
+	var err error
+
+	switch s.proto {
+	case "ptar":
+		s.host = "localhost"
+		s.root = strings.TrimPrefix(s.location, "ptar://")
+
+		if s.root == "-" {
+			return s.createStreaming(config)
+		}
+
+		fp, err = os.OpenFile(s.root, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+
+	case "ptar+oci":
+		// The registry only accepts a complete artifact in one push, so we
+		// stage the archive on disk exactly as we would for "ptar" and ship
+		// it as an OCI blob from Close.
+		s.host = strings.TrimPrefix(s.location, "ptar+oci://")
+		s.root = s.host
+
+		var tmp *os.File
+		tmp, err = os.CreateTemp("", "ptar-oci-*.tmp")
+		if err == nil {
+			s.ociStaging = tmp.Name()
+			fp = tmp
+		}
+
+	default:
 		return fmt.Errorf("unsupported protocol: %s", s.proto)
 	}
 
-	s.host = "localhost"
-
-	s.root = strings.TrimPrefix(s.location, "ptar://")
-	fp, err := os.OpenFile(s.root, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return err
 	}
 	s.fp = fp
 
-	fp.Write([]byte{'_', 'P', 'L', 'A', 'T', 'A', 'R', '_'})
+	fp.Write(footerMagic[:])
 
-	version := versioning.FromString("1.0.0")
+	version := versioning.FromString(currentVersion)
 	versionBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(versionBytes, uint32(version))
 	fp.Write(versionBytes)
 
-	fp.Write(config)
+	if _, err := rand.Read(s.salt[:]); err != nil {
+		return err
+	}
+
+	compression, key, flags, err := negotiateCodec(s.storeConfig, s.salt)
+	if err != nil {
+		return err
+	}
+	s.compression = compression
+	s.encKey = key
 
-	s.configOffset = 12
-	s.configLength = int64(len(config))
+	fp.Write([]byte{flags})
+	fp.Write(s.salt[:])
+
+	encoded, nonce, err := s.encodeSection(config)
+	if err != nil {
+		return err
+	}
+	fp.Write(encoded)
+
+	s.toc.Entries = append(s.toc.Entries, tocEntry{
+		MAC:         macOf(config),
+		Offset:      headerSize,
+		Length:      int64(len(encoded)),
+		Kind:        tocKindConfig,
+		CreatedAt:   time.Now(),
+		Compression: s.compression,
+		Nonce:       nonce,
+	})
+	s.dataEnd = headerSize + int64(len(encoded))
 	return nil
 }
 
 func (s *Store) Open(ctx context.Context) ([]byte, error) {
+	// mode=append reopens an already-Close'd archive for writing, so the
+	// next Put lands after the existing TOC instead of requiring a fresh
+	// Create: that's what turns this format into one capable of
+	// incremental snapshots to a single .ptar. It's only meaningful for a
+	// local file we can reopen O_RDWR -- HTTP and OCI archives stay
+	// read-only.
+	appendMode := s.storeConfig["mode"] == "append"
+
 	s.mode = storage.ModeRead
+	if appendMode {
+		s.mode |= storage.ModeWrite
+	}
 
 	var fp ReadWriteSeekStatReadAtCloser
 	var err error
@@ -114,9 +278,29 @@ func (s *Store) Open(ctx context.Context) ([]byte, error) {
 	case "ptar":
 		s.root = strings.TrimPrefix(s.location, "ptar://")
 		s.host = "hostname"
-		fp, err = os.Open(s.root)
+
+		if s.root == "-" {
+			if appendMode {
+				return nil, fmt.Errorf("ptar://- does not support mode=append")
+			}
+			return s.openStreaming()
+		}
+
+		if appendMode {
+			fp, err = os.OpenFile(s.root, os.O_RDWR, 0600)
+		} else {
+			fp, err = os.Open(s.root)
+		}
 
 	case "ptar+http", "ptar+https":
+		// Note: this only serves the seekable archive format over a
+		// range-capable HTTP server (see NewHTTPReader); the ptar://-
+		// sentinel and its frame-streamed format below are not wired up
+		// for ptar+http, so a URL that itself streams isn't supported yet.
+		if appendMode {
+			return nil, fmt.Errorf("%s does not support mode=append", s.proto)
+		}
+
 		url, err := url.Parse(s.location)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse url endpoint: %w", err)
@@ -128,6 +312,17 @@ func (s *Store) Open(ctx context.Context) ([]byte, error) {
 		location := strings.TrimPrefix(s.location, "ptar+")
 		fp, err = NewHTTPReader(location)
 
+	case "ptar+oci":
+		if appendMode {
+			return nil, fmt.Errorf("ptar+oci does not support mode=append")
+		}
+
+		ref := strings.TrimPrefix(s.location, "ptar+oci://")
+		s.host = ref
+		s.root = ref
+
+		fp, err = NewOCIReader(ref)
+
 	default:
 		return nil, fmt.Errorf("unsupported protocol: %s", s.proto)
 	}
@@ -143,7 +338,7 @@ func (s *Store) Open(ctx context.Context) ([]byte, error) {
 		return nil, err
 	}
 
-	if !bytes.Equal(magic, []byte("_PLATAR_")) {
+	if !bytes.Equal(magic, footerMagic[:]) {
 		return nil, storage.ErrInvalidMagic
 	}
 
@@ -153,33 +348,85 @@ func (s *Store) Open(ctx context.Context) ([]byte, error) {
 		return nil, err
 	}
 
-	_, err = fp.Seek(-48, io.SeekEnd)
-	if err != nil {
+	codecFlags := make([]byte, 1)
+	if _, err := io.ReadFull(fp, codecFlags); err != nil {
 		return nil, err
 	}
 
-	binary.Read(s.fp, binary.LittleEndian, &s.configOffset)
-	binary.Read(s.fp, binary.LittleEndian, &s.configLength)
-	binary.Read(s.fp, binary.LittleEndian, &s.packfileOffset)
-	binary.Read(s.fp, binary.LittleEndian, &s.packfileLength)
-	binary.Read(s.fp, binary.LittleEndian, &s.stateOffset)
-	binary.Read(s.fp, binary.LittleEndian, &s.stateLength)
+	if _, err := io.ReadFull(fp, s.salt[:]); err != nil {
+		return nil, err
+	}
 
-	_, err = fp.Seek(s.configOffset, io.SeekStart)
+	compression, key, err := resolveCodec(s.storeConfig, codecFlags[0], s.salt)
 	if err != nil {
 		return nil, err
 	}
+	s.compression = compression
+	s.encKey = key
 
-	if s.configLength <= 0 || s.configLength > 32*1024 {
-		return nil, fmt.Errorf("invalid configuration length: %s, file corrupted", humanize.IBytes(uint64(s.configLength)))
+	if _, err := fp.Seek(-footerSize, io.SeekEnd); err != nil {
+		return nil, err
 	}
 
-	config := make([]byte, s.configLength)
-	_, err = io.ReadFull(fp, config)
-	if err != nil {
+	var ft footer
+	if err := binary.Read(s.fp, binary.LittleEndian, &ft.TocOffset); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(s.fp, binary.LittleEndian, &ft.TocLength); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(s.fp, binary.LittleEndian, &ft.TocMAC); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(s.fp, binary.LittleEndian, &ft.Magic); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(s.fp, binary.LittleEndian, &ft.Version); err != nil {
+		return nil, err
+	}
+
+	if ft.Magic != footerMagic {
+		return nil, storage.ErrInvalidMagic
+	}
+
+	if ft.TocOffset <= 0 || ft.TocLength <= 0 {
+		return nil, fmt.Errorf("invalid table of contents, file corrupted")
+	}
+
+	tocBytes := make([]byte, ft.TocLength)
+	if _, err := fp.ReadAt(tocBytes, ft.TocOffset); err != nil {
 		return nil, err
 	}
-	s.config = config
+
+	if macOf(tocBytes) != ft.TocMAC {
+		return nil, fmt.Errorf("table of contents MAC mismatch, file truncated or corrupted")
+	}
+
+	var t toc
+	if err := json.Unmarshal(tocBytes, &t); err != nil {
+		return nil, fmt.Errorf("failed to decode table of contents: %w", err)
+	}
+	s.toc = t
+	s.dataEnd = ft.TocOffset + ft.TocLength
+
+	for _, entry := range s.toc.Entries {
+		if entry.Kind == tocKindConfig {
+			encoded := make([]byte, entry.Length)
+			if _, err := fp.ReadAt(encoded, entry.Offset); err != nil {
+				return nil, err
+			}
+			config, err := s.decodeSection(encoded, entry.Nonce)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode configuration: %w", err)
+			}
+			s.config = config
+			break
+		}
+	}
+
+	if s.config == nil {
+		return nil, fmt.Errorf("no configuration found in table of contents, file corrupted")
+	}
 
 	return s.config, nil
 }
@@ -198,6 +445,12 @@ func (s *Store) Ping(ctx context.Context) error {
 			return err
 		}
 
+	case "ptar+oci":
+		ref := strings.TrimPrefix(s.location, "ptar+oci://")
+		if _, err := NewOCIReader(ref); err != nil {
+			return err
+		}
+
 	default:
 		return fmt.Errorf("unsupported protocol: %s", s.proto)
 	}
@@ -206,13 +459,42 @@ func (s *Store) Ping(ctx context.Context) error {
 }
 
 func (s *Store) Close(ctx context.Context) error {
+	if s.streaming {
+		return s.closeStreaming()
+	}
+
 	if s.mode&storage.ModeWrite != 0 {
-		binary.Write(s.fp, binary.LittleEndian, s.configOffset)
-		binary.Write(s.fp, binary.LittleEndian, s.configLength)
-		binary.Write(s.fp, binary.LittleEndian, s.packfileOffset)
-		binary.Write(s.fp, binary.LittleEndian, s.packfileLength)
-		binary.Write(s.fp, binary.LittleEndian, s.stateOffset)
-		binary.Write(s.fp, binary.LittleEndian, s.stateLength)
+		tocBytes, err := json.Marshal(s.toc)
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.fp.Seek(s.dataEnd, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := s.fp.Write(tocBytes); err != nil {
+			return err
+		}
+
+		ft := footer{
+			TocOffset: s.dataEnd,
+			TocLength: int64(len(tocBytes)),
+			TocMAC:    macOf(tocBytes),
+			Magic:     footerMagic,
+			Version:   uint32(versioning.FromString(currentVersion)),
+		}
+
+		binary.Write(s.fp, binary.LittleEndian, ft.TocOffset)
+		binary.Write(s.fp, binary.LittleEndian, ft.TocLength)
+		binary.Write(s.fp, binary.LittleEndian, ft.TocMAC)
+		binary.Write(s.fp, binary.LittleEndian, ft.Magic)
+		binary.Write(s.fp, binary.LittleEndian, ft.Version)
+
+		if s.proto == "ptar+oci" {
+			if err := s.pushOCIArtifact(); err != nil {
+				return err
+			}
+		}
 	}
 	return s.fp.Close()
 }
@@ -233,7 +515,7 @@ func (s *Store) Flags() location.Flags {
 	switch s.proto {
 	case "ptar":
 		return location.FLAG_FILE | location.FLAG_LOCALFS
-	case "ptar+http", "ptar+https":
+	case "ptar+http", "ptar+https", "ptar+oci":
 		return location.FLAG_FILE
 	default:
 		return 0
@@ -245,6 +527,9 @@ func (s *Store) Mode(context.Context) (storage.Mode, error) {
 }
 
 func (s *Store) Size(ctx context.Context) (int64, error) {
+	if s.streaming {
+		return 0, fmt.Errorf("size is not available for a streaming ptar://- archive")
+	}
 	fi, err := s.fp.Stat()
 	if err != nil {
 		return 0, err
@@ -252,88 +537,167 @@ func (s *Store) Size(ctx context.Context) (int64, error) {
 	return fi.Size(), nil
 }
 
-func (s *Store) List(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
+// kindOf maps a storage.StorageResource to the tocEntryKind used in the TOC.
+func kindOf(res storage.StorageResource) (tocEntryKind, bool) {
 	switch res {
 	case storage.StorageResourceState:
-		if s.mode&storage.ModeWrite != 0 {
-			return []objects.MAC{}, nil
-		}
-
-		return []objects.MAC{
-			stateMAC,
-		}, nil
+		return tocKindState, true
 	case storage.StorageResourcePackfile:
-		return []objects.MAC{
-			packfileMAC,
-		}, nil
+		return tocKindPackfile, true
 	case storage.StorageResourceLock:
-		return []objects.MAC{}, nil
+		return tocKindLock, true
 	}
-
-	return nil, errors.ErrUnsupported
+	return "", false
 }
 
-func (s *Store) Put(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader) (int64, error) {
-	switch res {
-	case storage.StorageResourceState:
-		if s.mode&storage.ModeWrite == 0 {
-			return 0, storage.ErrNotWritable
-		}
+func (s *Store) List(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
+	kind, ok := kindOf(res)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
 
-		s.stateOffset = s.packfileOffset + s.packfileLength
-		nbytes, err := io.Copy(s.fp, rd)
-		if err != nil {
-			return 0, err
-		}
-		s.stateLength = nbytes
+	if res == storage.StorageResourceState && s.mode&storage.ModeWrite != 0 {
+		return []objects.MAC{}, nil
+	}
 
-		return nbytes, nil
-	case storage.StorageResourcePackfile:
-		if s.mode&storage.ModeWrite == 0 {
-			return 0, storage.ErrNotWritable
+	macs := []objects.MAC{}
+	for _, entry := range s.toc.Entries {
+		if entry.Kind == kind {
+			macs = append(macs, entry.MAC)
 		}
+	}
+	return macs, nil
+}
 
-		s.packfileOffset = s.configOffset + s.configLength
-		nbytes, err := io.Copy(s.fp, rd)
-		if err != nil {
-			return 0, err
+func (s *Store) findEntry(kind tocEntryKind, mac objects.MAC) (tocEntry, bool) {
+	for _, entry := range s.toc.Entries {
+		if entry.Kind == kind && entry.MAC == mac {
+			return entry, true
 		}
-		s.packfileLength = nbytes
+	}
+	return tocEntry{}, false
+}
 
-		return nbytes, nil
-	case storage.StorageResourceLock:
-		if s.mode&storage.ModeWrite == 0 {
-			return 0, storage.ErrNotWritable
-		}
+func (s *Store) Put(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader) (int64, error) {
+	kind, ok := kindOf(res)
+	if !ok {
+		return -1, errors.ErrUnsupported
+	}
+
+	if s.mode&storage.ModeWrite == 0 {
+		return 0, storage.ErrNotWritable
+	}
+
+	if res == storage.StorageResourceLock {
 		return 0, nil
 	}
 
-	return -1, errors.ErrUnsupported
+	if s.streaming {
+		return s.putStreaming(kind, mac, rd)
+	}
+
+	if res == storage.StorageResourcePackfile {
+		return s.putPackfile(mac, rd)
+	}
+
+	plain, err := io.ReadAll(rd)
+	if err != nil {
+		return 0, err
+	}
+
+	encoded, nonce, err := s.encodeSection(plain)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := s.dataEnd
+	if _, err := s.fp.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := s.fp.Write(encoded); err != nil {
+		return 0, err
+	}
+
+	s.toc.Entries = append(s.toc.Entries, tocEntry{
+		MAC:         mac,
+		Offset:      offset,
+		Length:      int64(len(encoded)),
+		Kind:        kind,
+		CreatedAt:   time.Now(),
+		Compression: s.compression,
+		Nonce:       nonce,
+	})
+	s.dataEnd = offset + int64(len(encoded))
+
+	return int64(len(plain)), nil
 }
 
 func (s *Store) Get(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
-	switch res {
-	case storage.StorageResourceState:
-		if mac != stateMAC {
-			return nil, fmt.Errorf("invalid MAC: %s", mac)
-		}
-		return io.NopCloser(io.NewSectionReader(s.fp, s.stateOffset, s.stateLength)), nil
-	case storage.StorageResourcePackfile:
-		if rg == nil {
-			return io.NopCloser(io.NewSectionReader(s.fp, s.packfileOffset, s.packfileLength)), nil
-		} else {
-			return io.NopCloser(io.NewSectionReader(s.fp, s.packfileOffset+int64(rg.Offset), int64(rg.Length))), nil
-		}
-	case storage.StorageResourceLock:
+	kind, ok := kindOf(res)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	if res == storage.StorageResourceLock {
 		return io.NopCloser(bytes.NewBuffer([]byte{})), nil
 	}
 
-	return nil, errors.ErrUnsupported
+	if s.streaming {
+		return s.getStreaming(kind, mac, rg)
+	}
+
+	entry, ok := s.findEntry(kind, mac)
+	if !ok {
+		return nil, fmt.Errorf("invalid MAC: %s", mac)
+	}
+
+	if res == storage.StorageResourcePackfile && entry.Format == tocFormatChunked {
+		return s.getPackfile(entry, rg)
+	}
+
+	encoded := make([]byte, entry.Length)
+	if _, err := s.fp.ReadAt(encoded, entry.Offset); err != nil {
+		return nil, err
+	}
+	plain, err := s.decodeSection(encoded, entry.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+
+	if rg == nil {
+		return io.NopCloser(bytes.NewReader(plain)), nil
+	}
+	lo, hi, err := clampRange(int64(len(plain)), rg)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(plain[lo:hi])), nil
 }
 
-func (s *Store) Delete(context.Context, storage.StorageResource, objects.MAC) error {
+// clampRange validates rg against a section of n decoded bytes, returning
+// the [lo:hi) bounds to slice rather than letting a bogus Range panic the
+// slice expression -- the old io.NewSectionReader-backed Get degraded an
+// out-of-range request to io.EOF instead of crashing, and this restores that.
+func clampRange(n int64, rg *storage.Range) (lo, hi int64, err error) {
+	lo = int64(rg.Offset)
+	hi = lo + int64(rg.Length)
+	if lo < 0 || hi < lo || lo > n {
+		return 0, 0, fmt.Errorf("range [%d:%d) out of bounds for %d bytes: %w", lo, hi, n, io.EOF)
+	}
+	if hi > n {
+		hi = n
+	}
+	return lo, hi, nil
+}
+
+func (s *Store) Delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) error {
 	if s.mode&storage.ModeWrite == 0 {
 		return storage.ErrNotWritable
 	}
+
+	if res == storage.StorageResourcePackfile {
+		return s.deletePackfile(mac)
+	}
+
 	return nil
 }
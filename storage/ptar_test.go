@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestClampRangeWithinBounds(t *testing.T) {
+	lo, hi, err := clampRange(10, &storage.Range{Offset: 2, Length: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lo != 2 || hi != 6 {
+		t.Fatalf("got [%d:%d), want [2:6)", lo, hi)
+	}
+}
+
+func TestClampRangeOverrunIsClamped(t *testing.T) {
+	lo, hi, err := clampRange(10, &storage.Range{Offset: 8, Length: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lo != 8 || hi != 10 {
+		t.Fatalf("got [%d:%d), want [8:10)", lo, hi)
+	}
+}
+
+func TestClampRangeStartPastEndReturnsError(t *testing.T) {
+	if _, _, err := clampRange(10, &storage.Range{Offset: 11, Length: 1}); err == nil {
+		t.Fatal("expected an error for a range starting past the end of the section")
+	}
+}
+
+// TestStoreCreatePutCloseReopenAppendGet drives a real ptar:// archive on a
+// temp file through Create/Put/Close, a mode=append reopen that Puts a
+// second entry, and a final read-only Open that must see both -- the
+// round trip the trailing TOC/footer format (and append-mode reopen) exist
+// to support.
+func TestStoreCreatePutCloseReopenAppendGet(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "archive.ptar")
+
+	config := []byte(`{"hello":"world"}`)
+	mac1 := objects.MAC{0x01}
+	payload1 := []byte("first snapshot state")
+
+	st, err := NewStore(ctx, "ptar", map[string]string{"location": "ptar://" + path})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := st.Create(ctx, config); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := st.Put(ctx, storage.StorageResourceState, mac1, bytes.NewReader(payload1)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := st.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	mac2 := objects.MAC{0x02}
+	payload2 := []byte("second snapshot state, written after reopening with mode=append")
+
+	st2, err := NewStore(ctx, "ptar", map[string]string{"location": "ptar://" + path, "mode": "append"})
+	if err != nil {
+		t.Fatalf("NewStore (append): %v", err)
+	}
+	if _, err := st2.Open(ctx); err != nil {
+		t.Fatalf("Open (append): %v", err)
+	}
+	if _, err := st2.Put(ctx, storage.StorageResourceState, mac2, bytes.NewReader(payload2)); err != nil {
+		t.Fatalf("Put after append reopen: %v", err)
+	}
+	if err := st2.Close(ctx); err != nil {
+		t.Fatalf("Close (append): %v", err)
+	}
+
+	st3, err := NewStore(ctx, "ptar", map[string]string{"location": "ptar://" + path})
+	if err != nil {
+		t.Fatalf("NewStore (final): %v", err)
+	}
+	gotConfig, err := st3.Open(ctx)
+	if err != nil {
+		t.Fatalf("Open (final): %v", err)
+	}
+	if !bytes.Equal(gotConfig, config) {
+		t.Fatalf("config round trip mismatch: got %q, want %q", gotConfig, config)
+	}
+
+	macs, err := st3.List(ctx, storage.StorageResourceState)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(macs) != 2 {
+		t.Fatalf("got %d state entries, want 2 (one from the first Put, one from the append reopen)", len(macs))
+	}
+
+	for _, tc := range []struct {
+		mac     objects.MAC
+		payload []byte
+	}{
+		{mac1, payload1},
+		{mac2, payload2},
+	} {
+		rc, err := st3.Get(ctx, storage.StorageResourceState, tc.mac, nil)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", tc.mac, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading Get(%s): %v", tc.mac, err)
+		}
+		if !bytes.Equal(got, tc.payload) {
+			t.Fatalf("Get(%s) = %q, want %q", tc.mac, got, tc.payload)
+		}
+	}
+
+	if err := st3.Close(ctx); err != nil {
+		t.Fatalf("Close (final): %v", err)
+	}
+}
+
+// TestStoreOpenRejectsCorruptedTOC flips a byte inside the on-disk TOC after
+// a normal Create/Put/Close, then asserts Open reports the corruption
+// (via the TOC MAC check) instead of silently accepting truncated/tampered
+// bytes or panicking.
+func TestStoreOpenRejectsCorruptedTOC(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "corrupt.ptar")
+
+	st, err := NewStore(ctx, "ptar", map[string]string{"location": "ptar://" + path})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := st.Create(ctx, []byte("config")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := st.Put(ctx, storage.StorageResourceState, objects.MAC{0x09}, bytes.NewReader([]byte("state"))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := st.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	footerBytes := raw[len(raw)-int(footerSize):]
+	tocOffset := int64(binary.LittleEndian.Uint64(footerBytes[:8]))
+	if tocOffset <= 0 || tocOffset >= int64(len(raw)) {
+		t.Fatalf("unexpected TocOffset %d in a %d-byte file", tocOffset, len(raw))
+	}
+	raw[tocOffset] ^= 0xff
+
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	st2, err := NewStore(ctx, "ptar", map[string]string{"location": "ptar://" + path})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if _, err := st2.Open(ctx); err == nil {
+		t.Fatal("expected Open to reject a corrupted table of contents")
+	}
+}
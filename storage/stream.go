@@ -0,0 +1,351 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/PlakarKorp/kloset/versioning"
+)
+
+// StreamWriter is all Create needs to produce a ptar://- archive: unlike
+// ReadWriteSeekStatReadAtCloser, it doesn't require Seek/ReadAt/Stat, so
+// os.Stdout (or any pipe) qualifies directly.
+type StreamWriter interface {
+	io.Writer
+}
+
+// StreamReader is all a streaming Open needs to consume a ptar://- archive.
+type StreamReader interface {
+	io.Reader
+}
+
+// frameKind tags each length-prefixed frame of the streaming format.
+type frameKind uint8
+
+const (
+	frameKindConfig   frameKind = 1
+	frameKindPackfile frameKind = 2
+	frameKindState    frameKind = 3
+	frameKindSentinel frameKind = 0xff
+)
+
+// streamKey indexes the in-memory blobs read off a streaming source, since
+// without random access there's no offset/length to keep in a TOC entry.
+type streamKey struct {
+	kind tocEntryKind
+	mac  objects.MAC
+}
+
+// writeFrame writes one section of the streaming format: a header
+// (kind, MAC, nonce length + nonce, payload length) immediately followed by
+// that many bytes of payload. Because the lengths are known upfront, a
+// streaming reader never has to seek to find out where a section ends. The
+// nonce is whatever encodeSection returned for payload, or empty if the
+// store wasn't configured with a passphrase; it travels alongside the frame
+// the same way a chunkEntry or tocEntry carries it on the seekable format.
+func writeFrame(w io.Writer, kind frameKind, mac objects.MAC, nonce, payload []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, kind); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, mac); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint8(len(nonce))); err != nil {
+		return err
+	}
+	if len(nonce) > 0 {
+		if _, err := w.Write(nonce); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame is the counterpart of writeFrame.
+func readFrame(r io.Reader) (frameKind, objects.MAC, []byte, []byte, error) {
+	var kind frameKind
+	if err := binary.Read(r, binary.LittleEndian, &kind); err != nil {
+		return 0, objects.MAC{}, nil, nil, err
+	}
+
+	var mac objects.MAC
+	if err := binary.Read(r, binary.LittleEndian, &mac); err != nil {
+		return 0, objects.MAC{}, nil, nil, err
+	}
+
+	var nonceLen uint8
+	if err := binary.Read(r, binary.LittleEndian, &nonceLen); err != nil {
+		return 0, objects.MAC{}, nil, nil, err
+	}
+	var nonce []byte
+	if nonceLen > 0 {
+		nonce = make([]byte, nonceLen)
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return 0, objects.MAC{}, nil, nil, err
+		}
+	}
+
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, objects.MAC{}, nil, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, objects.MAC{}, nil, nil, err
+	}
+
+	return kind, mac, nonce, payload, nil
+}
+
+func kindToFrameKind(kind tocEntryKind) (frameKind, bool) {
+	switch kind {
+	case tocKindConfig:
+		return frameKindConfig, true
+	case tocKindPackfile:
+		return frameKindPackfile, true
+	case tocKindState:
+		return frameKindState, true
+	}
+	return 0, false
+}
+
+// createStreaming writes the ptar://- variant of Create: the same 8-byte
+// magic and 4-byte version header, followed by the same codec header
+// (flags + scrypt salt) as the seekable format, followed by the config as
+// the first frame, encoded the same way every other frame is. There is no
+// footer -- a streaming reader finds the end of the archive by reading the
+// sentinel frame written by closeStreaming, not by seeking to a fixed
+// offset from the end.
+func (s *Store) createStreaming(config []byte) error {
+	s.streaming = true
+	s.streamOut = os.Stdout
+
+	if _, err := s.streamOut.Write(footerMagic[:]); err != nil {
+		return err
+	}
+
+	versionBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(versionBytes, uint32(versioning.FromString(currentVersion)))
+	if _, err := s.streamOut.Write(versionBytes); err != nil {
+		return err
+	}
+
+	if _, err := rand.Read(s.salt[:]); err != nil {
+		return err
+	}
+
+	compression, key, flags, err := negotiateCodec(s.storeConfig, s.salt)
+	if err != nil {
+		return err
+	}
+	s.compression = compression
+	s.encKey = key
+
+	if _, err := s.streamOut.Write([]byte{flags}); err != nil {
+		return err
+	}
+	if _, err := s.streamOut.Write(s.salt[:]); err != nil {
+		return err
+	}
+
+	encoded, nonce, err := s.encodeSection(config)
+	if err != nil {
+		return err
+	}
+
+	mac := macOf(config)
+	if err := writeFrame(s.streamOut, frameKindConfig, mac, nonce, encoded); err != nil {
+		return err
+	}
+
+	s.config = config
+	s.toc.Entries = append(s.toc.Entries, tocEntry{
+		MAC:         mac,
+		Length:      int64(len(encoded)),
+		Kind:        tocKindConfig,
+		CreatedAt:   time.Now(),
+		Compression: s.compression,
+		Nonce:       nonce,
+	})
+
+	return nil
+}
+
+// openStreaming reads frames off stdin until the sentinel, buffering every
+// section in memory since a pipe can't be seeked back into later when Get is
+// eventually called for one of them.
+func (s *Store) openStreaming() ([]byte, error) {
+	s.streaming = true
+	s.streamIn = os.Stdin
+	s.streamBlobs = make(map[streamKey][]byte)
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(s.streamIn, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(footerMagic[:]) {
+		return nil, storage.ErrInvalidMagic
+	}
+
+	versionBytes := make([]byte, 4)
+	if _, err := io.ReadFull(s.streamIn, versionBytes); err != nil {
+		return nil, err
+	}
+
+	codecFlags := make([]byte, 1)
+	if _, err := io.ReadFull(s.streamIn, codecFlags); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(s.streamIn, s.salt[:]); err != nil {
+		return nil, err
+	}
+
+	compression, key, err := resolveCodec(s.storeConfig, codecFlags[0], s.salt)
+	if err != nil {
+		return nil, err
+	}
+	s.compression = compression
+	s.encKey = key
+
+	for {
+		kind, mac, nonce, payload, err := readFrame(s.streamIn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read streaming archive: %w", err)
+		}
+
+		if kind == frameKindSentinel {
+			break
+		}
+
+		var tocKind tocEntryKind
+		switch kind {
+		case frameKindConfig:
+			tocKind = tocKindConfig
+		case frameKindPackfile:
+			tocKind = tocKindPackfile
+		case frameKindState:
+			tocKind = tocKindState
+		default:
+			return nil, fmt.Errorf("unknown frame kind: %d", kind)
+		}
+
+		plain, err := s.decodeSection(payload, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s frame: %w", tocKind, err)
+		}
+
+		s.streamBlobs[streamKey{kind: tocKind, mac: mac}] = plain
+		s.toc.Entries = append(s.toc.Entries, tocEntry{
+			MAC:         mac,
+			Length:      int64(len(plain)),
+			Kind:        tocKind,
+			CreatedAt:   time.Now(),
+			Compression: s.compression,
+			Nonce:       nonce,
+		})
+
+		if tocKind == tocKindConfig {
+			s.config = plain
+		}
+	}
+
+	if s.config == nil {
+		return nil, fmt.Errorf("no configuration found in streaming archive")
+	}
+
+	return s.config, nil
+}
+
+func (s *Store) putStreaming(kind tocEntryKind, mac objects.MAC, rd io.Reader) (int64, error) {
+	frKind, ok := kindToFrameKind(kind)
+	if !ok {
+		return -1, fmt.Errorf("unsupported resource for streaming archive: %s", kind)
+	}
+
+	plain, err := io.ReadAll(rd)
+	if err != nil {
+		return 0, err
+	}
+
+	encoded, nonce, err := s.encodeSection(plain)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeFrame(s.streamOut, frKind, mac, nonce, encoded); err != nil {
+		return 0, err
+	}
+
+	s.toc.Entries = append(s.toc.Entries, tocEntry{
+		MAC:         mac,
+		Length:      int64(len(encoded)),
+		Kind:        kind,
+		CreatedAt:   time.Now(),
+		Compression: s.compression,
+		Nonce:       nonce,
+	})
+
+	return int64(len(plain)), nil
+}
+
+func (s *Store) getStreaming(kind tocEntryKind, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
+	payload, ok := s.streamBlobs[streamKey{kind: kind, mac: mac}]
+	if !ok {
+		return nil, fmt.Errorf("invalid MAC: %s", mac)
+	}
+
+	if rg == nil {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	lo, hi, err := clampRange(int64(len(payload)), rg)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(payload[lo:hi])), nil
+}
+
+// closeStreaming finishes the archive with a sentinel frame whose payload is
+// the aggregate index of everything written. openStreaming stops at the
+// sentinel without decoding that payload; it rebuilds its entries from the
+// frames it has already read.
+func (s *Store) closeStreaming() error {
+	if s.streamOut == nil {
+		return nil
+	}
+
+	tocBytes, err := json.Marshal(s.toc)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(s.streamOut, frameKindSentinel, objects.MAC{}, nil, tocBytes)
+}
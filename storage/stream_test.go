@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestGetStreamingRangeOverrunDoesNotPanic(t *testing.T) {
+	s := &Store{streaming: true, streamBlobs: make(map[streamKey][]byte)}
+
+	mac := objects.MAC{0x01}
+	s.streamBlobs[streamKey{kind: tocKindState, mac: mac}] = []byte("hello")
+
+	rc, err := s.getStreaming(tocKindState, mac, &storage.Range{Offset: 2, Length: 1000})
+	if err != nil {
+		t.Fatalf("getStreaming: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, _ := rc.Read(buf)
+	if got, want := string(buf[:n]), "llo"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}